@@ -1,17 +1,33 @@
 package hcsshim
 
 import (
+	"context"
+	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
+	"github.com/Microsoft/hcsshim/internal/security"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/registry"
 )
 
+// rs5Build is the first Windows build to support Hyper-V isolation combined
+// with gMSA (group-managed service account) credential specs.
+const rs5Build = 17763
+
+// credentialSpecRegistryKey is where moby/docker looks up "registry://" gMSA
+// credential specs, written there by the CredentialSpec PowerShell module.
+const credentialSpecRegistryKey = `SOFTWARE\Microsoft\Windows NT\CurrentVersion\Virtualization\Containers\CredentialSpecs`
+
 // UVMFolderFromLayerFolders searches a set of layer folders which are indexed
 // from base layer at the bottom through sandbox at the top, finding the uppermost
 // layer containing the image.
@@ -35,6 +51,90 @@ func UVMFolderFromLayerFolders(layerFolders []string) (string, error) {
 	return uvmFolder, nil
 }
 
+// isLCOW returns true if createOptions describes a Linux Container on
+// Windows rather than a native Windows container. CreateOptions.OS, when
+// set, takes priority over sniffing the OCI spec so that callers which
+// already know the target platform don't pay for the Spec.Linux check.
+func isLCOW(createOptions *CreateOptions) bool {
+	if createOptions.OS != "" {
+		return strings.EqualFold(createOptions.OS, "linux")
+	}
+	return createOptions.Spec.Linux != nil
+}
+
+// createLCOWv2UVM creates a utility VM suitable for hosting LCOW containers.
+// Unlike createWCOWv2UVM, the UVM boots a Linux kernel and initrd rather than
+// UEFI/bootmgfw.efi, and read-only layers are shared into the guest over
+// VPMem rather than VSMB, as there's no Windows filter driver on the other
+// end to talk SMB to.
+func createLCOWv2UVM(createOptions *CreateOptions) (Container, error) {
+	logrus.Debugf("HCSShim: Creating LCOW utility VM id=%s", createOptions.Id)
+
+	if createOptions.Spec.Linux == nil {
+		return nil, fmt.Errorf("invalid OCI spec: Spec.Linux must be set to create an LCOW hosting system")
+	}
+	if createOptions.Spec.Windows == nil || createOptions.Spec.Windows.HyperV == nil {
+		return nil, fmt.Errorf("invalid OCI spec: Windows.HyperV must be set for an LCOW hosting system")
+	}
+	if len(createOptions.Spec.Windows.LayerFolders) != 1 {
+		return nil, fmt.Errorf("invalid OCI spec: Windows.LayerFolders must have length 1 for a hosting system, pointing to a folder containing the LCOW kernel and initrd")
+	}
+
+	memory := int32(1024)
+	processors := int32(2)
+	if numCPU() == 1 {
+		processors = 1
+	}
+	if createOptions.Spec.Linux.Resources != nil && createOptions.Spec.Linux.Resources.Memory != nil && createOptions.Spec.Linux.Resources.Memory.Limit != nil {
+		memory = int32(*createOptions.Spec.Linux.Resources.Memory.Limit / 1024 / 1024) // OCI spec is in bytes. HCS takes MB
+	}
+
+	uvmFolder := createOptions.Spec.Windows.HyperV.UtilityVMPath
+	if uvmFolder == "" {
+		uvmFolder = createOptions.Spec.Windows.LayerFolders[0]
+	}
+
+	uvm := &ComputeSystemV2{
+		Owner:         createOptions.Owner,
+		SchemaVersion: createOptions.SchemaVersion,
+		VirtualMachine: &VirtualMachineV2{
+			Chipset: &VirtualMachinesResourcesChipsetV2{
+				LinuxKernelDirect: &VirtualMachinesResourcesLinuxKernelDirectV2{
+					KernelFilePath: filepath.Join(uvmFolder, "kernel"),
+					InitRdPath:     filepath.Join(uvmFolder, "initrd.img"),
+					KernelCmdLine:  "initrd=\\initrd.img",
+				},
+			},
+			ComputeTopology: &VirtualMachinesResourcesComputeTopologyV2{
+				Memory: &VirtualMachinesResourcesComputeMemoryV2{
+					Backing: "Virtual",
+					Startup: memory,
+				},
+				Processor: &VirtualMachinesResourcesComputeProcessorV2{
+					Count: processors,
+				},
+			},
+			Devices: &VirtualMachinesDevicesV2{
+				// No VSMB layer sharing for LCOW - read-only layers are attached
+				// as VPMem devices by Mount(), and the scratch is SCSI-attached.
+				VPMemDevices:   make(map[string]VirtualMachinesResourcesStorageVPMemDeviceV2),
+				GuestInterface: &VirtualMachinesResourcesGuestInterfaceV2{ConnectToBridge: true},
+			},
+		},
+	}
+
+	uvmb, err := json.Marshal(uvm)
+	if err != nil {
+		return nil, err
+	}
+	uvmContainer, err := createContainer(createOptions.Id, string(uvmb), SchemaV20())
+	if err != nil {
+		logrus.Debugln("failed to create LCOW UVM: ", err)
+		return nil, err
+	}
+	return uvmContainer, nil
+}
+
 func createWCOWv2UVM(createOptions *CreateOptions) (Container, error) {
 	logrus.Debugf("HCSShim: Creating utility VM id=%s", createOptions.Id)
 
@@ -69,13 +169,20 @@ func createWCOWv2UVM(createOptions *CreateOptions) (Container, error) {
 
 	// TODO:  Default the utilty VMpath under HyperV in spec if not supplied
 
-	attachments := make(map[string]VirtualMachinesResourcesStorageAttachmentV2)
-	attachments["0"] = VirtualMachinesResourcesStorageAttachmentV2{
+	// Declare all four SCSI controllers up-front (64 LUNs apiece) so that later
+	// hot-adds via allocateSCSI have somewhere to land without a schema update.
+	// Only controller 0, LUN 0 is populated at create time, for the sandbox.
+	sandboxAttachment := VirtualMachinesResourcesStorageAttachmentV2{
 		Path: filepath.Join(createOptions.Spec.Windows.LayerFolders[0], "sandbox.vhdx"),
 		Type: "VirtualDisk",
 	}
 	scsi := make(map[string]VirtualMachinesResourcesStorageScsiV2)
-	scsi["0"] = VirtualMachinesResourcesStorageScsiV2{Attachments: attachments}
+	for controller := 0; controller < numSCSIControllers; controller++ {
+		scsi[strconv.Itoa(controller)] = VirtualMachinesResourcesStorageScsiV2{
+			Attachments: make(map[string]VirtualMachinesResourcesStorageAttachmentV2),
+		}
+	}
+	scsi["0"].Attachments["0"] = sandboxAttachment
 	memory := int32(1024)
 	processors := int32(2)
 	if numCPU() == 1 {
@@ -117,9 +224,10 @@ func createWCOWv2UVM(createOptions *CreateOptions) (Container, error) {
 				// Add networking here.... TODO
 				SCSI: scsi,
 				VirtualSMBShares: []VirtualMachinesResourcesStorageVSmbShareV2{VirtualMachinesResourcesStorageVSmbShareV2{
-					Flags: VsmbFlagReadOnly | VsmbFlagPseudoOplocks | VsmbFlagTakeBackupPrivilege | VsmbFlagCacheIO | VsmbFlagShareRead,
-					Name:  "os",
-					Path:  createOptions.Spec.Windows.HyperV.UtilityVMPath,
+					Flags:        osShareVSMBFlags(createOptions.VSMBShareOptions),
+					AllowedFiles: createOptions.VSMBShareOptions.AllowedFileExtensions,
+					Name:         "os",
+					Path:         createOptions.Spec.Windows.HyperV.UtilityVMPath,
 				}},
 				GuestInterface: &VirtualMachinesResourcesGuestInterfaceV2{ConnectToBridge: true},
 			},
@@ -135,18 +243,156 @@ func createWCOWv2UVM(createOptions *CreateOptions) (Container, error) {
 		logrus.Debugln("failed to create UVM: ", err)
 		return nil, err
 	}
-	uvmContainer.(*container).scsiLocations.hostPath[0][0] = attachments["0"].Path
+	uvmContainer.(*container).scsiLocations.hostPath[0][0] = sandboxAttachment.Path
 	return uvmContainer, nil
 }
 
+// defaultVSMBFlags is what every VSMB share used before per-layer options
+// were supported: read-only, pseudo-oplocks so the host doesn't block on
+// guest opens, backup privilege so ACLs don't get in the way, and cached IO.
+const defaultVSMBFlags = VsmbFlagReadOnly | VsmbFlagPseudoOplocks | VsmbFlagTakeBackupPrivilege | VsmbFlagCacheIO | VsmbFlagShareRead
+
+// VSMBShareOptions controls how a path is shared into a utility VM over
+// VSMB. The zero value reproduces today's behavior (defaultVSMBFlags, no
+// file restriction, cached IO). Flags, if non-zero, overrides the computed
+// base flags outright; TakeBackupPrivilege and DirectMap are instead
+// applied on top of whichever base is in effect (defaultVSMBFlags or an
+// explicit Flags), so they stay meaningful either way. DirectMap requests
+// direct file mapping instead of caching, for backing files that don't
+// tolerate the host cache (e.g. shares over slow storage).
+type VSMBShareOptions struct {
+	Flags                 int32
+	AllowedFileExtensions []string
+	TakeBackupPrivilege   bool
+	DirectMap             bool
+}
+
+// applyVSMBShareToggles layers TakeBackupPrivilege/DirectMap onto flags,
+// which is either an explicit Flags override or defaultVSMBFlags.
+func applyVSMBShareToggles(flags int32, opts VSMBShareOptions) int32 {
+	if opts.TakeBackupPrivilege {
+		flags |= VsmbFlagTakeBackupPrivilege
+	}
+	if opts.DirectMap {
+		flags &^= VsmbFlagCacheIO
+	}
+	return flags
+}
+
+// osShareVSMBFlags returns the flags to use for the "os" VSMB share backing
+// a WCOW utility VM's UtilityVMPath, honoring an explicit override but
+// otherwise falling back to defaultVSMBFlags, with TakeBackupPrivilege/
+// DirectMap applied on top either way.
+func osShareVSMBFlags(opts VSMBShareOptions) int32 {
+	flags := opts.Flags
+	if flags == 0 {
+		flags = defaultVSMBFlags
+	}
+	return applyVSMBShareToggles(flags, opts)
+}
+
+// vsmbShareID derives the VSMB share name (and ref-count map key) for a
+// layer path under a given set of options. Keying on (guid, optionsHash)
+// rather than guid alone means two callers asking for incompatible flags on
+// the same path get distinct shares instead of silently sharing one
+// configured for somebody else's needs.
+func vsmbShareID(guid string, opts VSMBShareOptions) (string, error) {
+	b, err := json.Marshal(opts)
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New32a()
+	h.Write(b)
+	return fmt.Sprintf("%s-%08x", guid, h.Sum32()), nil
+}
+
+// modifyWithContext runs req against hostingSystem, aborting early with
+// ctx.Err() if ctx is cancelled before Modify returns. Modify itself has no
+// ctx parameter to cancel, so the in-flight HCS call is left to finish on
+// its own goroutine; returning early just stops Mount/Unmount from blocking
+// on it past the caller's deadline, letting the usual failure-cleanup path
+// run immediately.
+func modifyWithContext(ctx context.Context, hostingSystem Container, req *ModifySettingsRequestV2) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- hostingSystem.Modify(req)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// addVSMBShare shares path into hostingSystem over VSMB using opts,
+// ref-counting on (path, opts) so sibling containers asking for the same
+// path with the same options reuse the existing share. It returns the
+// share's resource id, which callers use as the Layers[].Id in a
+// CombinedLayersV2 and pass back to removeVSMB to tear it down.
+func addVSMBShare(ctx context.Context, hostingSystem Container, path string, opts VSMBShareOptions) (string, error) {
+	c := hostingSystem.(*container)
+	_, filename := filepath.Split(path)
+	guid, err := NameToGuid(filename)
+	if err != nil {
+		return "", err
+	}
+	id, err := vsmbShareID(guid.ToString(), opts)
+	if err != nil {
+		return "", err
+	}
+
+	c.vsmbShares.Lock()
+	defer c.vsmbShares.Unlock()
+	if c.vsmbShares.guids == nil {
+		c.vsmbShares.guids = make(map[string]int)
+	}
+	if _, ok := c.vsmbShares.guids[id]; !ok {
+		flags := opts.Flags
+		if flags == 0 {
+			flags = defaultVSMBFlags
+		}
+		flags = applyVSMBShareToggles(flags, opts)
+		modification := &ModifySettingsRequestV2{
+			ResourceType: ResourceTypeVSmbShare,
+			RequestType:  RequestTypeAdd,
+			Settings: VirtualMachinesResourcesStorageVSmbShareV2{
+				Name:         id,
+				Flags:        flags,
+				AllowedFiles: opts.AllowedFileExtensions,
+				Path:         path,
+			},
+			ResourceUri: fmt.Sprintf("virtualmachine/devices/virtualsmbshares/%s", id),
+		}
+		if err := modifyWithContext(ctx, hostingSystem, modification); err != nil {
+			return "", err
+		}
+		c.vsmbShares.guids[id] = 1
+	} else {
+		c.vsmbShares.guids[id]++
+	}
+	logrus.WithContext(ctx).WithFields(logrus.Fields{"vsmbGUID": id, "operation": "addVSMBShare"}).Debugf("HCSShim::addVSMBShare %s: refcount=%d", path, c.vsmbShares.guids[id])
+	return id, nil
+}
+
+// AddVSMBShare is the public entry point for sharing an arbitrary host path
+// into a running utility VM over VSMB with caller-supplied options. Mount
+// uses it internally for read-only layers; callers with their own paths to
+// share (e.g. a plugin serving files from slow storage that needs DirectMap)
+// can call it directly.
+func AddVSMBShare(ctx context.Context, c Container, path string, opts VSMBShareOptions) (string, error) {
+	return addVSMBShare(ctx, c, path, opts)
+}
+
 // removeVSMB removes a VSMB share from a utility VM. The mutex must be
 // held when calling this function
-func removeVSMB(c Container, id string) error {
-	logrus.Debugf("HCSShim: Removing vsmb %s", id)
+func removeVSMB(ctx context.Context, c Container, id string) error {
+	logger := logrus.WithContext(ctx).WithFields(logrus.Fields{"vsmbGUID": id, "operation": "removeVSMB"})
+	logger.Debugf("HCSShim: Removing vsmb %s", id)
 	if _, ok := c.(*container).vsmbShares.guids[id]; !ok {
 		return fmt.Errorf("failed to remove vsmbShare %s as it is not in utility VM %s", id, c.(*container).id)
 	} else {
-		logrus.Debugf("VSMB: %s refcount: %d", id, c.(*container).vsmbShares.guids[id])
+		logger.Debugf("VSMB: %s refcount: %d", id, c.(*container).vsmbShares.guids[id])
 		c.(*container).vsmbShares.guids[id]--
 		if c.(*container).vsmbShares.guids[id] == 0 {
 			delete(c.(*container).vsmbShares.guids, id)
@@ -157,7 +403,7 @@ func removeVSMB(c Container, id string) error {
 				Settings:    VirtualMachinesResourcesStorageVSmbShareV2{Name: id},
 				ResourceUri: fmt.Sprintf("virtualmachine/devices/virtualsmbshares/%s", id),
 			}
-			if err := c.Modify(modification); err != nil {
+			if err := modifyWithContext(ctx, c, modification); err != nil {
 				return fmt.Errorf("failed to remove vsmbShare %s from utility VM %s after refcount dropped to zero: %s", id, c.(*container).id, err)
 			}
 		}
@@ -166,22 +412,76 @@ func removeVSMB(c Container, id string) error {
 }
 
 // removeVSMBOnFailure is a helper to roll-back any VSMB shares added to a utility VM on a failure path
-func removeVSMBOnFailure(c Container, toRemove []string) {
+func removeVSMBOnFailure(ctx context.Context, c Container, toRemove []string) {
 	if len(toRemove) == 0 {
 		return
 	}
 	c.(*container).vsmbShares.Lock()
 	defer c.(*container).vsmbShares.Unlock()
 	for _, vsmbShare := range toRemove {
-		if err := removeVSMB(c, vsmbShare); err != nil {
-			logrus.Warnf("Possibly leaked vsmbshare on error removal path: %s", err)
+		if err := removeVSMB(ctx, c, vsmbShare); err != nil {
+			logrus.WithContext(ctx).Warnf("Possibly leaked vsmbshare on error removal path: %s", err)
+		}
+	}
+}
+
+// numSCSIControllers and numSCSILUNsPerController bound the SCSI topology a
+// v2 utility VM is created with - see createWCOWv2UVM - giving allocateSCSI
+// 256 hot-addable slots rather than the single controller/LUN 0 this shim
+// originally supported.
+const (
+	numSCSIControllers       = 4
+	numSCSILUNsPerController = 64
+)
+
+// allocateSCSI finds an unused (controller, lun) slot for hostPath on c and
+// records it so removeSCSI/findSCSIAttachment can find it again. It does not
+// hot-add the disk itself; AddVirtualDisk issues that Modify call. Slots are handed out round-robin
+// across controllers - filling LUN 0 on every controller before LUN 1 on
+// any of them - so attachments are spread evenly rather than piling onto
+// controller 0 until it's exhausted. The mutex must NOT be held when
+// calling this function.
+func allocateSCSI(c *container, hostPath string, containerPath string) (int, int, error) {
+	c.scsiLocations.Lock()
+	defer c.scsiLocations.Unlock()
+	return allocateSCSILocked(c, hostPath)
+}
+
+// allocateSCSILocked is allocateSCSI's slot-finding loop, factored out so
+// AddVirtualDisk can reuse it while already holding c.scsiLocations' mutex
+// (recording the attachment and issuing the Modify call atomically). The
+// mutex MUST be held when calling this function.
+func allocateSCSILocked(c *container, hostPath string) (int, int, error) {
+	for lun := 0; lun < numSCSILUNsPerController; lun++ {
+		for controller := 0; controller < numSCSIControllers; controller++ {
+			if c.scsiLocations.hostPath[controller][lun] == "" {
+				c.scsiLocations.hostPath[controller][lun] = hostPath
+				return controller, lun, nil
+			}
+		}
+	}
+	return -1, -1, fmt.Errorf("no free SCSI locations for %s - all %d controllers with %d LUNs each are full", hostPath, numSCSIControllers, numSCSILUNsPerController)
+}
+
+// findSCSIAttachment returns the (controller, lun) that hostPath was
+// attached to by a prior allocateSCSI call. The mutex must be held when
+// calling this function. ctx is accepted, rather than used directly, so
+// that future log calls here pick up the caller's fields/cancellation
+// without another signature change.
+func findSCSIAttachment(ctx context.Context, c *container, hostPath string) (int, int, error) {
+	for controller := 0; controller < numSCSIControllers; controller++ {
+		for lun := 0; lun < numSCSILUNsPerController; lun++ {
+			if c.scsiLocations.hostPath[controller][lun] == hostPath {
+				return controller, lun, nil
+			}
 		}
 	}
+	return -1, -1, fmt.Errorf("%s is not attached to SCSI", hostPath)
 }
 
 // removeSCSI removes a mapped virtual disk from a containers SCSI controller. The mutex
 // MUST be held when calling this function
-func removeSCSI(c Container, controller int, lun int, containerPath string) error {
+func removeSCSI(ctx context.Context, c Container, controller int, lun int, containerPath string) error {
 	scsiModification := &ModifySettingsRequestV2{
 		ResourceType: ResourceTypeMappedVirtualDisk,
 		RequestType:  RequestTypeRemove,
@@ -190,10 +490,11 @@ func removeSCSI(c Container, controller int, lun int, containerPath string) erro
 	if containerPath != "" {
 		scsiModification.HostedSettings = ContainersResourcesMappedDirectoryV2{
 			ContainerPath: containerPath,
+			Controller:    uint8(controller),
 			Lun:           uint8(lun),
 		}
 	}
-	if err := c.Modify(scsiModification); err != nil {
+	if err := modifyWithContext(ctx, c, scsiModification); err != nil {
 		return err
 	}
 	c.(*container).scsiLocations.hostPath[controller][lun] = ""
@@ -202,12 +503,360 @@ func removeSCSI(c Container, controller int, lun int, containerPath string) erro
 
 // removeSCSIOnFailure is a helper to roll-back a SCSI disk added to a utility VM on a failure path.
 // The mutex  must NOT be held when calling this function.
-func removeSCSIOnFailure(c Container, controller int, lun int) {
+func removeSCSIOnFailure(ctx context.Context, c Container, controller int, lun int) {
 	c.(*container).scsiLocations.Lock()
 	defer c.(*container).scsiLocations.Unlock()
-	if err := removeSCSI(c, controller, lun, ""); err != nil {
-		logrus.Warnf("Possibly leaked SCSI disk on error removal path: %s", err)
+	if err := removeSCSI(ctx, c, controller, lun, ""); err != nil {
+		logrus.WithContext(ctx).Warnf("Possibly leaked SCSI disk on error removal path: %s", err)
+	}
+}
+
+// VMAccessType controls what additional access Mount grants a hosting VM to
+// a SCSI-attached virtual disk's host file, beyond the attachment itself
+// (e.g. relaxing an ACL so the vmwp/gcs process can read it). Today only
+// VMAccessTypeNoop preserves today's behavior of leaving ACLs alone, for
+// callers like containerd that already pre-ACL layer directories out of
+// band. VMAccessTypeGroup and VMAccessTypeIndividual have AddVirtualDisk
+// grant access to hostPath before attaching it, for callers that don't.
+type VMAccessType int
+
+const (
+	// VMAccessTypeNoop grants no additional access - the default, matching
+	// the shim's behavior before AddVirtualDisk existed.
+	VMAccessTypeNoop VMAccessType = iota
+	// VMAccessTypeGroup grants access to the utility VM's compute group,
+	// via security.GrantVmGroupAccess. Appropriate when every VM on the
+	// host is allowed to read the file.
+	VMAccessTypeGroup
+	// VMAccessTypeIndividual grants access to this specific VM's SID only,
+	// revoked again by RemoveVirtualDisk once the attachment is released.
+	VMAccessTypeIndividual
+)
+
+// grantVMAccess ACLs hostPath for access before it's attached to c, per
+// access. It is a no-op for VMAccessTypeNoop.
+func grantVMAccess(c *container, access VMAccessType, hostPath string) error {
+	switch access {
+	case VMAccessTypeNoop:
+		return nil
+	case VMAccessTypeGroup:
+		return security.GrantVmGroupAccess(hostPath)
+	case VMAccessTypeIndividual:
+		return security.GrantVmAccess(c.id, hostPath)
+	default:
+		return fmt.Errorf("unknown VMAccessType %d", access)
+	}
+}
+
+// revokeVMAccess undoes grantVMAccess's VMAccessTypeIndividual grant once
+// hostPath is no longer attached to c. Group access is deliberately left in
+// place - it isn't specific to this VM, so nothing this shim did should be
+// revoking it here.
+func revokeVMAccess(c *container, access VMAccessType, hostPath string) error {
+	if access != VMAccessTypeIndividual {
+		return nil
+	}
+	return security.RevokeVmAccess(c.id, hostPath)
+}
+
+// SCSIMountConfig tells AddVirtualDisk how, if at all, to expose an
+// attached disk to the guest. A nil config, or one with an empty GuestPath,
+// attaches the disk without mounting it anywhere; the caller is then
+// responsible for referencing the attachment itself, as mountLCOW's VPMem
+// fallback does by building a CombinedLayersV2 entry from the returned
+// scsiMount's Controller/Lun rather than its GuestPath.
+type SCSIMountConfig struct {
+	// GuestPath is the ContainerPath HCS exposes the disk at inside the
+	// hosting VM.
+	GuestPath string
+}
+
+// scsiMount is the handle AddVirtualDisk hands back: a SCSI attachment,
+// optionally with a guest mount point layered on top of it. Both layers are
+// ref-counted (see scsiLocations.attachRefs/mountRefs), so the same host
+// file can be attached once and reused - at one guest path or several - by
+// sibling containers or repeated Mount calls without HCS ever seeing
+// duplicate attach/detach requests.
+type scsiMount struct {
+	controller, lun int
+	guestPath       string
+}
+
+// GuestPath returns the path the disk is exposed at inside the hosting VM,
+// or "" if AddVirtualDisk was called with no mount config.
+func (m *scsiMount) GuestPath() string { return m.guestPath }
+
+// Controller and Lun identify the SCSI attachment backing this mount.
+func (m *scsiMount) Controller() int { return m.controller }
+func (m *scsiMount) Lun() int        { return m.lun }
+
+// scsiMountKey identifies a single guest mount point layered on top of a
+// SCSI attachment, for scsiMountRefs.
+func scsiMountKey(controller, lun int, guestPath string) string {
+	return fmt.Sprintf("%d:%d:%s", controller, lun, guestPath)
+}
+
+// AddVirtualDisk attaches hostPath to hostingSystem over SCSI - reusing an
+// existing attachment if hostPath is already attached - and, if mountConfig
+// names a GuestPath, exposes it to the guest there. This splits what used
+// to be a single allocateSCSI+Modify call into two independently
+// ref-counted layers: the attachment (scsiLocations.attachRefs) and the
+// guest mount point on top of it (scsiLocations.mountRefs). That split is what lets the same
+// scratch or read-only layer be mounted at more than one guest path, or
+// shared by sibling containers, and torn down in the right order by
+// RemoveVirtualDisk.
+func AddVirtualDisk(ctx context.Context, hostingSystem Container, hostPath string, readOnly bool, access VMAccessType, mountConfig *SCSIMountConfig) (*scsiMount, error) {
+	c := hostingSystem.(*container)
+	c.scsiLocations.Lock()
+	defer c.scsiLocations.Unlock()
+	if c.scsiLocations.attachRefs == nil {
+		c.scsiLocations.attachRefs = make(map[string]int)
+		c.scsiLocations.mountRefs = make(map[string]int)
+		c.scsiLocations.accessGranted = make(map[string]VMAccessType)
+	}
+
+	controller, lun, err := findSCSIAttachment(ctx, c, hostPath)
+	newlyAttached := err != nil
+	if newlyAttached {
+		if err := grantVMAccess(c, access, hostPath); err != nil {
+			return nil, err
+		}
+		controller, lun, err = allocateSCSILocked(c, hostPath)
+		if err != nil {
+			if rvErr := revokeVMAccess(c, access, hostPath); rvErr != nil {
+				logrus.WithContext(ctx).WithFields(logrus.Fields{"operation": "AddVirtualDisk"}).Warnf("Possibly leaked VM access grant on error removal path: %s", rvErr)
+			}
+			return nil, err
+		}
+		c.scsiLocations.accessGranted[hostPath] = access
+		attachModification := &ModifySettingsRequestV2{
+			ResourceType: ResourceTypeMappedVirtualDisk,
+			RequestType:  RequestTypeAdd,
+			Settings: VirtualMachinesResourcesStorageAttachmentV2{
+				Path:     hostPath,
+				Type:     "VirtualDisk",
+				ReadOnly: readOnly,
+			},
+			ResourceUri: fmt.Sprintf("VirtualMachine/Devices/SCSI/%d/%d", controller, lun),
+		}
+		logrus.WithContext(ctx).WithFields(logrus.Fields{"controller": controller, "lun": lun, "operation": "AddVirtualDisk"}).Debugf("HCSShim::AddVirtualDisk attaching %s", hostPath)
+		if err := modifyWithContext(ctx, hostingSystem, attachModification); err != nil {
+			c.scsiLocations.hostPath[controller][lun] = ""
+			delete(c.scsiLocations.accessGranted, hostPath)
+			if rvErr := revokeVMAccess(c, access, hostPath); rvErr != nil {
+				logrus.WithContext(ctx).WithFields(logrus.Fields{"controller": controller, "lun": lun, "operation": "AddVirtualDisk"}).Warnf("Possibly leaked VM access grant on error removal path: %s", rvErr)
+			}
+			return nil, err
+		}
+	}
+	c.scsiLocations.attachRefs[hostPath]++
+
+	mount := &scsiMount{controller: controller, lun: lun}
+	if mountConfig != nil && mountConfig.GuestPath != "" {
+		key := scsiMountKey(controller, lun, mountConfig.GuestPath)
+		if c.scsiLocations.mountRefs[key] == 0 {
+			mountModification := &ModifySettingsRequestV2{
+				ResourceType: ResourceTypeMappedVirtualDisk,
+				RequestType:  RequestTypeAdd,
+				ResourceUri:  fmt.Sprintf("VirtualMachine/Devices/SCSI/%d/%d", controller, lun),
+				HostedSettings: ContainersResourcesMappedDirectoryV2{
+					ContainerPath: mountConfig.GuestPath,
+					Controller:    uint8(controller),
+					Lun:           uint8(lun),
+				},
+			}
+			if err := modifyWithContext(ctx, hostingSystem, mountModification); err != nil {
+				c.scsiLocations.attachRefs[hostPath]--
+				if newlyAttached && c.scsiLocations.attachRefs[hostPath] <= 0 {
+					delete(c.scsiLocations.attachRefs, hostPath)
+					delete(c.scsiLocations.accessGranted, hostPath)
+					if rmErr := removeSCSI(ctx, hostingSystem, controller, lun, ""); rmErr != nil {
+						logrus.WithContext(ctx).WithFields(logrus.Fields{"controller": controller, "lun": lun, "operation": "AddVirtualDisk"}).Warnf("Possibly leaked SCSI disk on error removal path: %s", rmErr)
+					} else if rvErr := revokeVMAccess(c, access, hostPath); rvErr != nil {
+						logrus.WithContext(ctx).WithFields(logrus.Fields{"controller": controller, "lun": lun, "operation": "AddVirtualDisk"}).Warnf("Possibly leaked VM access grant on error removal path: %s", rvErr)
+					}
+				}
+				return nil, err
+			}
+		}
+		c.scsiLocations.mountRefs[key]++
+		mount.guestPath = mountConfig.GuestPath
+	}
+	return mount, nil
+}
+
+// RemoveVirtualDisk releases mount, removing its guest mount point (if any)
+// once no other caller references it, and detaching the underlying SCSI
+// disk once its attach refcount likewise drops to zero.
+func RemoveVirtualDisk(ctx context.Context, hostingSystem Container, mount *scsiMount) error {
+	c := hostingSystem.(*container)
+	c.scsiLocations.Lock()
+	defer c.scsiLocations.Unlock()
+	hostPath := c.scsiLocations.hostPath[mount.controller][mount.lun]
+
+	if mount.guestPath != "" {
+		key := scsiMountKey(mount.controller, mount.lun, mount.guestPath)
+		c.scsiLocations.mountRefs[key]--
+		if c.scsiLocations.mountRefs[key] <= 0 {
+			delete(c.scsiLocations.mountRefs, key)
+			unmountModification := &ModifySettingsRequestV2{
+				ResourceType: ResourceTypeMappedVirtualDisk,
+				RequestType:  RequestTypeRemove,
+				ResourceUri:  fmt.Sprintf("VirtualMachine/Devices/SCSI/%d/%d", mount.controller, mount.lun),
+				HostedSettings: ContainersResourcesMappedDirectoryV2{
+					ContainerPath: mount.guestPath,
+					Controller:    uint8(mount.controller),
+					Lun:           uint8(mount.lun),
+				},
+			}
+			if err := modifyWithContext(ctx, hostingSystem, unmountModification); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.scsiLocations.attachRefs[hostPath]--
+	if c.scsiLocations.attachRefs[hostPath] > 0 {
+		return nil
+	}
+	delete(c.scsiLocations.attachRefs, hostPath)
+	access := c.scsiLocations.accessGranted[hostPath]
+	delete(c.scsiLocations.accessGranted, hostPath)
+	if err := removeSCSI(ctx, hostingSystem, mount.controller, mount.lun, ""); err != nil {
+		return err
+	}
+	return revokeVMAccess(c, access, hostPath)
+}
+
+// resolveCredentialSpec turns the short-hand forms moby accepts for
+// Windows.CredentialSpec - "registry://<ValueName>", read from the well-known
+// CredentialSpecs registry key, and "file://<filename>", read from the
+// CredentialSpecs subdirectory of createOptions.Root (the daemon root) -
+// into the literal JSON blob HCS expects. Anything else is assumed to
+// already be a literal JSON credential spec and is returned unchanged.
+func resolveCredentialSpec(createOptions *CreateOptions, raw string) (string, error) {
+	var resolved string
+	switch {
+	case strings.HasPrefix(raw, "registry://"):
+		valueName := raw[len("registry://"):]
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, credentialSpecRegistryKey, registry.QUERY_VALUE)
+		if err != nil {
+			return "", fmt.Errorf("failed to open CredentialSpecs registry key: %s", err)
+		}
+		defer k.Close()
+		resolved, _, err = k.GetStringValue(valueName)
+		if err != nil {
+			return "", fmt.Errorf("failed to read credential spec %q from the registry: %s", valueName, err)
+		}
+	case strings.HasPrefix(raw, "file://"):
+		filename := raw[len("file://"):]
+		specDir := filepath.Join(createOptions.Root, "CredentialSpecs")
+		path := filepath.Join(specDir, filename)
+		if rel, err := filepath.Rel(specDir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("invalid credential spec file %q: must not escape the CredentialSpecs directory", filename)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read credential spec file %q: %s", filename, err)
+		}
+		resolved = string(b)
+	default:
+		resolved = raw
+	}
+
+	if strings.TrimSpace(resolved) == "" {
+		return "", fmt.Errorf("resolved credential spec is empty")
 	}
+	if !json.Valid([]byte(resolved)) {
+		return "", fmt.Errorf("resolved credential spec is not valid JSON")
+	}
+	return resolved, nil
+}
+
+// ImagePlatform describes the platform an image was built for, so that
+// CreateHCSContainerDocument can reject a mismatched image with a clear,
+// typed error up front instead of HCS failing deep with an opaque one.
+// Mirrors the platform fields of an OCI image index/manifest.
+type ImagePlatform struct {
+	OS           string
+	Architecture string
+	OSVersion    string
+}
+
+// PlatformMismatchReason is a machine-readable classification of why an
+// ImagePlatform was rejected.
+type PlatformMismatchReason string
+
+const (
+	PlatformMismatchReasonOS           PlatformMismatchReason = "os_mismatch"
+	PlatformMismatchReasonArchitecture PlatformMismatchReason = "architecture_mismatch"
+	PlatformMismatchReasonOSVersion    PlatformMismatchReason = "os_version_newer_than_host"
+)
+
+// PlatformMismatchError is returned when CreateOptions.ImagePlatform cannot
+// run on this host.
+type PlatformMismatchError struct {
+	Reason  PlatformMismatchReason
+	Message string
+}
+
+func (e *PlatformMismatchError) Error() string { return e.Message }
+
+// buildNumberFromOSVersion extracts the trailing build number from an
+// OSVersion string such as "10.0.17763", tolerating a bare build number too.
+func buildNumberFromOSVersion(osVersion string) (int, error) {
+	parts := strings.Split(osVersion, ".")
+	build, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse build number from OSVersion %q: %s", osVersion, err)
+	}
+	return build, nil
+}
+
+// validateImagePlatform rejects an image whose declared ImagePlatform can't
+// run on this host: the wrong OS family (Linux layers on a Windows-only host
+// path, or vice versa), a mismatched architecture, or - for process-isolated
+// WCOW, where there's no hypervisor to bridge the version gap - a guest build
+// newer than the host. A caller which hasn't populated ImagePlatform (it's
+// the zero value) gets no check, preserving today's behavior.
+func validateImagePlatform(createOptions *CreateOptions) error {
+	p := createOptions.ImagePlatform
+	if p.OS == "" {
+		return nil
+	}
+
+	hostOS := "windows"
+	if isLCOW(createOptions) {
+		hostOS = "linux"
+	}
+	if !strings.EqualFold(p.OS, hostOS) {
+		return &PlatformMismatchError{
+			Reason:  PlatformMismatchReasonOS,
+			Message: fmt.Sprintf("cannot create HCS container document - image platform OS %q cannot run on this host (%q)", p.OS, hostOS),
+		}
+	}
+
+	if p.Architecture != "" && !strings.EqualFold(p.Architecture, "amd64") {
+		return &PlatformMismatchError{
+			Reason:  PlatformMismatchReasonArchitecture,
+			Message: fmt.Sprintf("cannot create HCS container document - image platform architecture %q cannot run on this host", p.Architecture),
+		}
+	}
+
+	isHyperV := createOptions.Spec.Windows != nil && createOptions.Spec.Windows.HyperV != nil
+	if !isHyperV && p.OSVersion != "" {
+		imageBuild, err := buildNumberFromOSVersion(p.OSVersion)
+		if err != nil {
+			return err
+		}
+		if hostBuild := int(GetOSVersion().Build); imageBuild > hostBuild {
+			return &PlatformMismatchError{
+				Reason:  PlatformMismatchReasonOSVersion,
+				Message: fmt.Sprintf("cannot create HCS container document - image build %d is newer than host build %d and cannot run process-isolated", imageBuild, hostBuild),
+			}
+		}
+	}
+	return nil
 }
 
 // CreateHCSContainerDocument creates a document suitable for calling HCS to create
@@ -224,6 +873,14 @@ func CreateHCSContainerDocument(createOptions *CreateOptions) (string, error) {
 		return "", fmt.Errorf("cannot create HCS container document - OCI spec is missing")
 	}
 
+	if err := validateImagePlatform(createOptions); err != nil {
+		return "", err
+	}
+
+	if isLCOW(createOptions) {
+		return createLCOWHCSContainerDocument(createOptions)
+	}
+
 	if createOptions.Spec.Windows == nil {
 		return "", fmt.Errorf("cannot create HCS container document - OCI spec Windows section is missing ")
 	}
@@ -325,9 +982,20 @@ func CreateHCSContainerDocument(createOptions *CreateOptions) (string, error) {
 		v2Container.Networking.NetworkSharedContainerName = v1.NetworkSharedContainerName
 	}
 
-	//	// TODO V2 Credentials not in the schema yet.
-	if cs, ok := createOptions.Spec.Windows.CredentialSpec.(string); ok {
-		v1.Credentials = cs
+	if createOptions.Spec.Windows.CredentialSpec != nil {
+		raw, ok := createOptions.Spec.Windows.CredentialSpec.(string)
+		if !ok {
+			return "", fmt.Errorf("invalid container spec - Windows.CredentialSpec must be a string")
+		}
+		if createOptions.Spec.Windows.HyperV != nil && GetOSVersion().Build < rs5Build {
+			return "", fmt.Errorf("gMSA credential specs are not supported with Hyper-V isolation on builds earlier than RS5 (%d)", rs5Build)
+		}
+		resolved, err := resolveCredentialSpec(createOptions, raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid container spec - Windows.CredentialSpec: %s", err)
+		}
+		v1.Credentials = resolved
+		v2Container.Credentials = resolved
 	}
 
 	// We must have least two layers in the spec - a base and RW layer.
@@ -457,98 +1125,388 @@ func CreateHCSContainerDocument(createOptions *CreateOptions) (string, error) {
 	}
 }
 
+// createLCOWHCSContainerDocument builds the v2 schema document for an LCOW
+// container. There is no v1 LCOW schema, and LCOW containers are always
+// hosted (there is no process-isolated LCOW), so this is considerably
+// simpler than the WCOW equivalent.
+func createLCOWHCSContainerDocument(createOptions *CreateOptions) (string, error) {
+	if createOptions.SchemaVersion.IsV10() {
+		return "", fmt.Errorf("cannot create HCS container document - LCOW requires the v2 schema")
+	}
+	if createOptions.HostingSystem == nil {
+		return "", fmt.Errorf("cannot create HCS container document - LCOW containers must be hosted in a utility VM")
+	}
+	if createOptions.MountedLayers == nil {
+		return "", fmt.Errorf("v2 schema call for a hosted container must supply mounted layers")
+	}
+
+	v2 := &ComputeSystemV2{
+		Owner:                             createOptions.Owner,
+		SchemaVersion:                     createOptions.SchemaVersion,
+		ShouldTerminateOnLastHandleClosed: true,
+		HostingSystemId:                   createOptions.HostingSystem.(*container).id,
+		HostedSystem: &HostedSystemV2{
+			SchemaVersion: SchemaV20(),
+			Container: &ContainerV2{
+				Storage: createOptions.MountedLayers,
+			},
+		},
+	}
+
+	if createOptions.Spec.Hostname != "" {
+		v2.HostedSystem.Container.GuestOS = &GuestOsV2{HostName: createOptions.Spec.Hostname}
+	}
+
+	v2b, err := json.Marshal(v2)
+	if err != nil {
+		return "", err
+	}
+	logrus.Debugln("hcsshim: HCS Document:", string(v2b))
+	return string(v2b), nil
+}
+
+// MountedLayers is the result of a successful Mount call.
+//
+// v1/v2: Argon WCOW:      only RootFS, the mount path on the host, is set.
+// v2:    Xenon WCOW/LCOW: Layers is the CombinedLayersV2 structure that must be
+//                         threaded into CreateOptions.MountedLayers, and RootFS
+//                         echoes Layers.ContainerRootPath for convenience.
+type MountedLayers struct {
+	RootFS string
+	Layers *CombinedLayersV2
+}
+
+// ResourceCloser releases the resources a Mount call attached to a hosting
+// system - layer activations, VSMB shares, VPMem devices and SCSI attachments -
+// so a caller doesn't have to re-derive GUIDs or SCSI locations from layer
+// paths to tear a mount back down symmetrically. Release is safe to call
+// once; a second call is a no-op returning nil.
+//
+// For a hypervisor-isolated sandbox/pause container, a caller may choose to
+// simply drop the closer instead of calling Release, since terminating the
+// UVM cleans up the VSMB shares, VPMem devices and SCSI attachments anyway.
+type ResourceCloser interface {
+	Release(ctx context.Context) error
+}
+
+// argonCloser tears down an Argon (process-isolated) mount: no hosting
+// system is involved, so there are no VSMB/SCSI resources to release, just
+// the layer activation done by PrepareLayer/ActivateLayer.
+type argonCloser struct {
+	released bool
+	di       DriverInfo
+	id       string
+}
+
+func (a *argonCloser) Release(ctx context.Context) error {
+	if a.released {
+		return nil
+	}
+	if err := UnprepareLayer(a.di, a.id); err != nil {
+		return err
+	}
+	if err := DeactivateLayer(a.di, a.id); err != nil {
+		return err
+	}
+	a.released = true
+	return nil
+}
+
+// wcowXenonCloser tears down a WCOW v2 hosted mount: the combined layers
+// filter, the SCSI-attached sandbox, and the VSMB shares added for the
+// read-only layers, in that order.
+type wcowXenonCloser struct {
+	released          bool
+	hostingSystem     Container
+	containerRootPath string
+	sandbox           *scsiMount
+	vsmbAdded         []string
+}
+
+func (w *wcowXenonCloser) Release(ctx context.Context) error {
+	if w.released {
+		return nil
+	}
+	combinedLayersModification := &ModifySettingsRequestV2{
+		ResourceType:   ResourceTypeCombinedLayers,
+		RequestType:    RequestTypeRemove,
+		HostedSettings: CombinedLayersV2{ContainerRootPath: w.containerRootPath},
+	}
+	if err := modifyWithContext(ctx, w.hostingSystem, combinedLayersModification); err != nil {
+		return err
+	}
+	c := w.hostingSystem.(*container)
+	c.combinedLayers.Lock()
+	delete(c.combinedLayers.paths, w.containerRootPath)
+	c.combinedLayers.Unlock()
+	if err := RemoveVirtualDisk(ctx, w.hostingSystem, w.sandbox); err != nil {
+		return err
+	}
+	w.hostingSystem.(*container).vsmbShares.Lock()
+	defer w.hostingSystem.(*container).vsmbShares.Unlock()
+	for _, vsmbShare := range w.vsmbAdded {
+		if err := removeVSMB(ctx, w.hostingSystem, vsmbShare); err != nil {
+			return err
+		}
+	}
+	w.released = true
+	return nil
+}
+
+// currentMountStateVersion is bumped whenever MountState's layout changes in
+// a way Load can't read across. Load rejects any other value outright
+// rather than guessing at zero-valued fields for a layout it doesn't know.
+const currentMountStateVersion = 1
+
+// MountState is a gob-encodable snapshot of the ref-counted VSMB, SCSI, and
+// CombinedLayers bookkeeping Mount/Unmount maintain on a container. Without
+// it, a shim restart - or seeding a UVM cloned from a running template -
+// loses every ref-count and GUID/layer-path mapping, leaking the
+// corresponding shares and attachments on the next Unmount.
+type MountState struct {
+	SerialVersion int
+	VSMB          map[string]VSMBEntry
+	SCSI          []SCSIEntry
+	Combined      []CombinedLayerEntry
+}
+
+// VSMBEntry is one VSMB share's ref count, keyed in MountState.VSMB by the
+// share id vsmbShareID returned for it.
+type VSMBEntry struct {
+	RefCount int
+}
+
+// SCSIEntry is one SCSI attachment and the guest mount points layered on
+// top of it (see AddVirtualDisk).
+type SCSIEntry struct {
+	Controller    int
+	Lun           int
+	HostPath      string
+	AttachRefs    int
+	AccessGranted VMAccessType
+	Mounts        []SCSIMountEntry
+}
+
+// SCSIMountEntry is one guest mount point on top of an SCSIEntry's
+// attachment, keyed by GuestPath with its own ref count (see scsiMountKey).
+type SCSIMountEntry struct {
+	GuestPath string
+	RefCount  int
+}
+
+// CombinedLayerEntry is one guest overlay assembled by a
+// ResourceTypeCombinedLayers Modify call.
+type CombinedLayerEntry struct {
+	ContainerRootPath string
+}
+
+// VirtualMachinePropertiesV2 is the subset of a v2 schema Properties query
+// this package reads back, to check a loaded MountState against what a
+// hosting VM actually still has attached rather than trusting it blindly.
+type VirtualMachinePropertiesV2 struct {
+	ScsiAttachments map[string]bool // keyed by "controller:lun"
+	VSMBShares      map[string]bool // keyed by share id (see vsmbShareID)
+}
+
+// Properties queries the live v2 schema resources HCS reports for c, so
+// Load can tell a MountState entry that genuinely still exists apart from
+// one that's stale. The query itself is answered by c's underlying HCS
+// system handle, same as the Modify calls elsewhere in this file.
+func (c *container) Properties(ctx context.Context) (*VirtualMachinePropertiesV2, error) {
+	return c.hcsSystem.virtualMachineProperties(ctx)
+}
+
+// Save gob-encodes a snapshot of c's VSMB/SCSI/CombinedLayers bookkeeping to
+// w. It takes the same locks Mount and Unmount do, so a Save racing either
+// sees a consistent state, not a partial one.
+func (c *container) Save(w io.Writer) error {
+	c.vsmbShares.Lock()
+	vsmb := make(map[string]VSMBEntry, len(c.vsmbShares.guids))
+	for guid, refCount := range c.vsmbShares.guids {
+		vsmb[guid] = VSMBEntry{RefCount: refCount}
+	}
+	c.vsmbShares.Unlock()
+
+	c.scsiLocations.Lock()
+	mountsByAttachment := make(map[string][]SCSIMountEntry)
+	for key, refCount := range c.scsiLocations.mountRefs {
+		parts := strings.SplitN(key, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		attachKey := parts[0] + ":" + parts[1]
+		mountsByAttachment[attachKey] = append(mountsByAttachment[attachKey], SCSIMountEntry{GuestPath: parts[2], RefCount: refCount})
+	}
+	var scsi []SCSIEntry
+	for controller := 0; controller < numSCSIControllers; controller++ {
+		for lun := 0; lun < numSCSILUNsPerController; lun++ {
+			hostPath := c.scsiLocations.hostPath[controller][lun]
+			if hostPath == "" {
+				continue
+			}
+			attachKey := fmt.Sprintf("%d:%d", controller, lun)
+			scsi = append(scsi, SCSIEntry{
+				Controller:    controller,
+				Lun:           lun,
+				HostPath:      hostPath,
+				AttachRefs:    c.scsiLocations.attachRefs[hostPath],
+				AccessGranted: c.scsiLocations.accessGranted[hostPath],
+				Mounts:        mountsByAttachment[attachKey],
+			})
+		}
+	}
+	c.scsiLocations.Unlock()
+
+	c.combinedLayers.Lock()
+	combined := make([]CombinedLayerEntry, 0, len(c.combinedLayers.paths))
+	for path := range c.combinedLayers.paths {
+		combined = append(combined, CombinedLayerEntry{ContainerRootPath: path})
+	}
+	c.combinedLayers.Unlock()
+
+	return gob.NewEncoder(w).Encode(&MountState{
+		SerialVersion: currentMountStateVersion,
+		VSMB:          vsmb,
+		SCSI:          scsi,
+		Combined:      combined,
+	})
+}
+
+// Load decodes a MountState written by Save and reconciles it against c's
+// live resources, queried fresh from HCS: an entry HCS no longer reports -
+// because, say, the hosting VM was recreated rather than resumed - is
+// dropped instead of being restored into the ref-count tables, so Unmount
+// never tries to detach something that was never actually there.
+func (c *container) Load(r io.Reader) error {
+	var state MountState
+	if err := gob.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	if state.SerialVersion != currentMountStateVersion {
+		return fmt.Errorf("hcsshim: unsupported MountState version %d (want %d)", state.SerialVersion, currentMountStateVersion)
+	}
+
+	live, err := c.Properties(context.Background())
+	if err != nil {
+		return err
+	}
+
+	c.vsmbShares.Lock()
+	c.vsmbShares.guids = make(map[string]int, len(state.VSMB))
+	for guid, entry := range state.VSMB {
+		if !live.VSMBShares[guid] {
+			logrus.Warnf("hcsshim: dropping stale VSMB share %s from loaded MountState - not present on %s", guid, c.id)
+			continue
+		}
+		c.vsmbShares.guids[guid] = entry.RefCount
+	}
+	c.vsmbShares.Unlock()
+
+	c.scsiLocations.Lock()
+	c.scsiLocations.attachRefs = make(map[string]int)
+	c.scsiLocations.mountRefs = make(map[string]int)
+	c.scsiLocations.accessGranted = make(map[string]VMAccessType)
+	for _, entry := range state.SCSI {
+		if !live.ScsiAttachments[fmt.Sprintf("%d:%d", entry.Controller, entry.Lun)] {
+			logrus.Warnf("hcsshim: dropping stale SCSI attachment %d:%d (%s) from loaded MountState - not present on %s", entry.Controller, entry.Lun, entry.HostPath, c.id)
+			continue
+		}
+		c.scsiLocations.hostPath[entry.Controller][entry.Lun] = entry.HostPath
+		c.scsiLocations.attachRefs[entry.HostPath] = entry.AttachRefs
+		c.scsiLocations.accessGranted[entry.HostPath] = entry.AccessGranted
+		for _, m := range entry.Mounts {
+			c.scsiLocations.mountRefs[scsiMountKey(entry.Controller, entry.Lun, m.GuestPath)] = m.RefCount
+		}
+	}
+	c.scsiLocations.Unlock()
+
+	c.combinedLayers.Lock()
+	c.combinedLayers.paths = make(map[string]bool, len(state.Combined))
+	for _, entry := range state.Combined {
+		c.combinedLayers.paths[entry.ContainerRootPath] = true
+	}
+	c.combinedLayers.Unlock()
+
+	return nil
+}
+
 // Mount is a helper for clients to hide all the complexity of layer mounting
 // Layer folder are in order: base, [rolayer1..rolayern,] sandbox
-// TODO: Extend for LCOW?
 //
 // v1/v2: Argon WCOW: Returns the mount path on the host as a volume GUID.
 // v1:    Xenon WCOW: Done internally in HCS, so no point calling doing anything here.
 // v2:    Xenon WCOW: Returns a CombinedLayersV2 structure where ContainerRootPath is a folder
 //                    inside the utility VM which is a GUID mapping of the sandbox folder. Each
 //                    of the layers are the VSMB locations where the read-only layers are mounted.
-
-// TODO Should this return a string or an object? More efficient as object, but requires more client work to marshall it again.
-func Mount(layerFolders []string, hostingSystem Container, sv *SchemaVersion) (interface{}, error) {
+// Mount attaches layerFolders to hostingSystem. vsmbOptions, keyed by layer
+// folder path, lets a caller override the VSMB flags used for individual
+// read-only layers (e.g. DirectMap for a layer backed by slow storage); a
+// layer with no entry gets defaultVSMBFlags. vsmbOptions is ignored outside
+// the v2 hosted-WCOW path, since v1 and LCOW don't use VSMB for layers.
+// sandboxAccess controls whether Mount ACLs the sandbox VHD for the
+// hosting VM before attaching it over SCSI; pass VMAccessTypeNoop (the
+// default today's callers get) if the caller already manages that ACL out
+// of band. ctx scopes logging and cancellation: if ctx is cancelled while a
+// SCSI hot-add or VSMB add is in flight, Mount aborts the wait on it and
+// runs the same failure-cleanup path it would for an HCS error.
+func Mount(ctx context.Context, layerFolders []string, hostingSystem Container, sv *SchemaVersion, vsmbOptions map[string]VSMBShareOptions, sandboxAccess VMAccessType) (*MountedLayers, ResourceCloser, error) {
+	logger := logrus.WithContext(ctx).WithField("layerFolders", layerFolders)
 	if err := sv.isSupported(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if sv.IsV10() ||
 		(sv.IsV20() && hostingSystem == nil) {
 		if len(layerFolders) < 2 {
-			return nil, fmt.Errorf("need at least two layers - base and sandbox")
+			return nil, nil, fmt.Errorf("need at least two layers - base and sandbox")
 		}
 		id := filepath.Base(layerFolders[len(layerFolders)-1])
 		homeDir := filepath.Dir(layerFolders[len(layerFolders)-1])
 		di := DriverInfo{HomeDir: homeDir}
 
 		if err := ActivateLayer(di, id); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if err := PrepareLayer(di, id, layerFolders[:len(layerFolders)-1]); err != nil {
 			if err2 := DeactivateLayer(di, id); err2 != nil {
-				logrus.Warnf("Failed to Deactivate %s: %s", id, err)
+				logger.Warnf("Failed to Deactivate %s: %s", id, err)
 			}
-			return nil, err
+			return nil, nil, err
 		}
 
 		mountPath, err := GetLayerMountPath(di, id)
 		if err != nil {
 			if err := UnprepareLayer(di, id); err != nil {
-				logrus.Warnf("Failed to Unprepare %s: %s", id, err)
+				logger.Warnf("Failed to Unprepare %s: %s", id, err)
 			}
 			if err2 := DeactivateLayer(di, id); err2 != nil {
-				logrus.Warnf("Failed to Deactivate %s: %s", id, err)
+				logger.Warnf("Failed to Deactivate %s: %s", id, err)
 			}
-			return nil, err
+			return nil, nil, err
 		}
-		return mountPath, nil
+		return &MountedLayers{RootFS: mountPath}, &argonCloser{di: di, id: id}, nil
+	}
+
+	if hostingSystem.(*container).os == "linux" {
+		return mountLCOW(ctx, layerFolders, hostingSystem, sandboxAccess)
 	}
 
 	// V2 UVM
 
-	// 	Add each read-only layers as a VSMB share. In each case, the ResourceUri will end in a GUID based on the folder path.
-	//  Each VSMB share is ref-counted so that multiple containers in the same utility VM can share them.
-	// TODO OK check here.
-	c := hostingSystem.(*container)
-	c.vsmbShares.Lock()
-	if c.vsmbShares.guids == nil {
-		c.vsmbShares.guids = make(map[string]int)
-	}
+	// 	Add each read-only layer as a VSMB share. In each case, the ResourceUri will end in an id based
+	//  on the folder path and the options used, and each share is ref-counted so that multiple containers
+	//  in the same utility VM can share them.
 	var vsmbAdded []string
-	logrus.Debugln("hcsshim::Mount v2 for hosted system")
+	logger.Debugln("hcsshim::Mount v2 for hosted system")
 	for _, layerPath := range layerFolders[:len(layerFolders)-1] {
-		logrus.Debugf("hcsshim::Mount %s as VSMB share", layerPath)
-		_, filename := filepath.Split(layerPath)
-		guid, err := NameToGuid(filename)
+		logger.Debugf("hcsshim::Mount %s as VSMB share", layerPath)
+		opts := vsmbOptions[layerPath]
+		id, err := addVSMBShare(ctx, hostingSystem, layerPath, opts)
 		if err != nil {
-			removeVSMBOnFailure(hostingSystem, vsmbAdded)
-			c.vsmbShares.Unlock()
-			return nil, err
-		}
-		if _, ok := c.vsmbShares.guids[guid.ToString()]; !ok {
-			modification := &ModifySettingsRequestV2{
-				ResourceType: ResourceTypeVSmbShare,
-				RequestType:  RequestTypeAdd,
-				Settings: VirtualMachinesResourcesStorageVSmbShareV2{
-					Name:  guid.ToString(),
-					Flags: VsmbFlagReadOnly | VsmbFlagPseudoOplocks | VsmbFlagTakeBackupPrivilege | VsmbFlagCacheIO | VsmbFlagShareRead,
-					Path:  layerPath,
-				},
-				ResourceUri: fmt.Sprintf("virtualmachine/devices/virtualsmbshares/%s", guid.ToString()),
-			}
-			if err := hostingSystem.Modify(modification); err != nil {
-				c.vsmbShares.Unlock()
-				removeVSMBOnFailure(hostingSystem, vsmbAdded)
-				return nil, err
-			}
-			c.vsmbShares.guids[guid.ToString()] = 1
-		} else {
-			c.vsmbShares.guids[guid.ToString()]++
+			removeVSMBOnFailure(ctx, hostingSystem, vsmbAdded)
+			return nil, nil, err
 		}
-		vsmbAdded = append(vsmbAdded, guid.ToString())
-		logrus.Debugf("HCSShim::Mount %s: refcount=%d", layerPath, c.vsmbShares.guids[guid.ToString()])
+		vsmbAdded = append(vsmbAdded, id)
 	}
-	c.vsmbShares.Unlock()
 
 	// 	Add the sandbox at an unused SCSI location. The container path inside the utility VM will be C:\<GUID> where
 	// 	GUID is based on the folder in which the sandbox is located. Therefore, it is critical that if two containers
@@ -557,40 +1515,15 @@ func Mount(layerFolders []string, hostingSystem Container, sv *SchemaVersion) (i
 	_, sandboxPath := filepath.Split(layerFolders[len(layerFolders)-1])
 	containerPathGUID, err := NameToGuid(sandboxPath)
 	if err != nil {
-		removeVSMBOnFailure(hostingSystem, vsmbAdded)
-		return nil, err
+		removeVSMBOnFailure(ctx, hostingSystem, vsmbAdded)
+		return nil, nil, err
 	}
 	hostPath := filepath.Join(layerFolders[len(layerFolders)-1], "sandbox.vhdx")
 	containerPath := fmt.Sprintf(`C:\%s`, containerPathGUID.ToString())
-	controller, lun, err := allocateSCSI(c, hostPath, containerPath)
+	sandbox, err := AddVirtualDisk(ctx, hostingSystem, hostPath, false, sandboxAccess, &SCSIMountConfig{GuestPath: containerPath})
 	if err != nil {
-		removeVSMBOnFailure(hostingSystem, vsmbAdded)
-		return nil, err
-	}
-
-	// TODO: Currently GCS doesn't support more than one SCSI controller. @jhowardmsft/@swernli. This will hopefully be fixed in GCS for RS5.
-	// It will also require the HostedSettings to be extended in the call below to include the controller as well as the LUN.
-	if controller > 0 {
-		return nil, fmt.Errorf("too many SCSI attachments for a single controller")
-	}
-
-	sandboxModification := &ModifySettingsRequestV2{
-		ResourceType: ResourceTypeMappedVirtualDisk,
-		RequestType:  RequestTypeAdd,
-		Settings: VirtualMachinesResourcesStorageAttachmentV2{
-			Path: hostPath,
-			Type: "VirtualDisk",
-			// TODO Hmmm....  Where do we do this now????  IgnoreFlushes: createOptions.Spec.Windows.IgnoreFlushesDuringBoot,
-		},
-		ResourceUri: fmt.Sprintf("VirtualMachine/Devices/SCSI/%d/%d", controller, lun),
-		HostedSettings: ContainersResourcesMappedDirectoryV2{
-			ContainerPath: containerPath,
-			Lun:           uint8(lun),
-		},
-	}
-	if err := hostingSystem.Modify(sandboxModification); err != nil {
-		removeVSMBOnFailure(hostingSystem, vsmbAdded)
-		return nil, err
+		removeVSMBOnFailure(ctx, hostingSystem, vsmbAdded)
+		return nil, nil, err
 	}
 
 	// 	Load the filter at the C:\<GUID> location calculated above. We pass into this request each of the
@@ -611,14 +1544,347 @@ func Mount(layerFolders []string, hostingSystem Container, sv *SchemaVersion) (i
 		RequestType:    RequestTypeAdd,
 		HostedSettings: combinedLayers,
 	}
-	if err := hostingSystem.Modify(combinedLayersModification); err != nil {
-		removeVSMBOnFailure(hostingSystem, vsmbAdded)
-		removeSCSIOnFailure(hostingSystem, controller, lun)
-		return nil, err
+	logger = logger.WithField("containerRootPath", combinedLayers.ContainerRootPath)
+	if err := modifyWithContext(ctx, hostingSystem, combinedLayersModification); err != nil {
+		removeVSMBOnFailure(ctx, hostingSystem, vsmbAdded)
+		if err := RemoveVirtualDisk(ctx, hostingSystem, sandbox); err != nil {
+			logger.Warnf("Possibly leaked SCSI disk on error removal path: %s", err)
+		}
+		return nil, nil, err
+	}
+
+	c := hostingSystem.(*container)
+	c.combinedLayers.Lock()
+	if c.combinedLayers.paths == nil {
+		c.combinedLayers.paths = make(map[string]bool)
+	}
+	c.combinedLayers.paths[combinedLayers.ContainerRootPath] = true
+	c.combinedLayers.Unlock()
+
+	logger.Debugln("HCSShim::Mount Succeeded")
+	closer := &wcowXenonCloser{
+		hostingSystem:     hostingSystem,
+		containerRootPath: combinedLayers.ContainerRootPath,
+		sandbox:           sandbox,
+		vsmbAdded:         vsmbAdded,
+	}
+	return &MountedLayers{RootFS: combinedLayers.ContainerRootPath, Layers: &combinedLayers}, closer, nil
+}
+
+// MountLegacy calls Mount with context.Background(), for callers built
+// before ctx became Mount's first argument.
+func MountLegacy(layerFolders []string, hostingSystem Container, sv *SchemaVersion, vsmbOptions map[string]VSMBShareOptions, sandboxAccess VMAccessType) (*MountedLayers, ResourceCloser, error) {
+	return Mount(context.Background(), layerFolders, hostingSystem, sv, vsmbOptions, sandboxAccess)
+}
+
+// maxVPMemCount is the number of VPMem device slots allocateVPMem hands out
+// on an LCOW UVM. Once they're all in use, Mount falls back to attaching further read-only
+// layers over SCSI instead of failing outright.
+const maxVPMemCount = 128
+
+// MaxVPMemLayerSizeBytes bounds how large a read-only layer may be before
+// Mount attaches it over SCSI rather than VPMem, since a VPMem device is a
+// fixed-size memory-mapped window and very large layers don't fit it well.
+// Zero, the default, disables the size-based fallback; only VPMem slot
+// exhaustion then triggers SCSI.
+var MaxVPMemLayerSizeBytes int64
+
+// errVPMemExhausted is returned by allocateVPMem when every VPMem slot is
+// already in use, as a signal to the caller to fall back to SCSI rather
+// than failing Mount outright.
+var errVPMemExhausted = fmt.Errorf("no free VPMem devices")
+
+// scsiLayerID formats the Id used for a read-only layer that Mount attached
+// over SCSI instead of VPMem - see allocateSCSIROLayer.
+func scsiLayerID(controller, lun int) string {
+	return fmt.Sprintf("scsi:%d:%d", controller, lun)
+}
+
+// mountLCOW mounts a set of LCOW layer folders into hostingSystem. Each
+// read-only layer is attached to the UVM as a VPMem device where possible -
+// there's no Windows SMB server in the guest to talk to, so VSMB isn't an
+// option - falling back to a SCSI attachment when VPMem slots are exhausted
+// or the layer is too large for one (see MaxVPMemLayerSizeBytes). The
+// scratch is always SCSI-attached. The overlayfs itself is assembled by a
+// guest request to the GCS (the same CombinedLayers Modify call used for
+// WCOW, just routed to the guest instead of the host), rooted at a path
+// under /run/gcs/c/<id>.
+func mountLCOW(ctx context.Context, layerFolders []string, hostingSystem Container, sandboxAccess VMAccessType) (*MountedLayers, ResourceCloser, error) {
+	if len(layerFolders) < 2 {
+		return nil, nil, fmt.Errorf("need at least two layers - base and sandbox")
+	}
+	c := hostingSystem.(*container)
+	logger := logrus.WithContext(ctx).WithField("layerFolders", layerFolders)
+
+	logger.Debugln("hcsshim::Mount v2 LCOW for hosted system")
+	var layers []ContainersResourcesLayerV2
+	var vpmemAdded []string
+	var scsiROLayersAdded []*scsiMount
+	for _, layerPath := range layerFolders[:len(layerFolders)-1] {
+		if !vpmemFitsLayer(layerPath) {
+			mount, err := allocateSCSIROLayer(ctx, hostingSystem, layerPath)
+			if err != nil {
+				removeVPMemOnFailure(hostingSystem, vpmemAdded)
+				removeSCSIROLayersOnFailure(ctx, hostingSystem, scsiROLayersAdded)
+				return nil, nil, err
+			}
+			scsiROLayersAdded = append(scsiROLayersAdded, mount)
+			layers = append(layers, ContainersResourcesLayerV2{
+				Id:   scsiLayerID(mount.Controller(), mount.Lun()),
+				Path: fmt.Sprintf("/tmp/scsi%d-%d", mount.Controller(), mount.Lun()),
+			})
+			continue
+		}
+
+		logger.Debugf("hcsshim::Mount %s as VPMem device", layerPath)
+		deviceNumber, err := allocateVPMem(c, layerPath)
+		if err == errVPMemExhausted {
+			logger.Debugf("hcsshim::Mount VPMem exhausted, falling back to SCSI for %s", layerPath)
+			mount, err := allocateSCSIROLayer(ctx, hostingSystem, layerPath)
+			if err != nil {
+				removeVPMemOnFailure(hostingSystem, vpmemAdded)
+				removeSCSIROLayersOnFailure(ctx, hostingSystem, scsiROLayersAdded)
+				return nil, nil, err
+			}
+			scsiROLayersAdded = append(scsiROLayersAdded, mount)
+			layers = append(layers, ContainersResourcesLayerV2{
+				Id:   scsiLayerID(mount.Controller(), mount.Lun()),
+				Path: fmt.Sprintf("/tmp/scsi%d-%d", mount.Controller(), mount.Lun()),
+			})
+			continue
+		}
+		if err != nil {
+			removeVPMemOnFailure(hostingSystem, vpmemAdded)
+			removeSCSIROLayersOnFailure(ctx, hostingSystem, scsiROLayersAdded)
+			return nil, nil, err
+		}
+		vpmemAdded = append(vpmemAdded, layerPath)
+		layers = append(layers, ContainersResourcesLayerV2{
+			Id:   fmt.Sprintf("%d", deviceNumber),
+			Path: fmt.Sprintf("/tmp/vpmem%d", deviceNumber),
+		})
+	}
+
+	_, sandboxPath := filepath.Split(layerFolders[len(layerFolders)-1])
+	containerID, err := NameToGuid(sandboxPath)
+	if err != nil {
+		removeVPMemOnFailure(hostingSystem, vpmemAdded)
+		removeSCSIROLayersOnFailure(ctx, hostingSystem, scsiROLayersAdded)
+		return nil, nil, err
+	}
+	hostPath := filepath.Join(layerFolders[len(layerFolders)-1], "sandbox.vhdx")
+	containerRootPath := fmt.Sprintf("/run/gcs/c/%s/rootfs", containerID.ToString())
+	logger = logger.WithField("containerRootPath", containerRootPath)
+	sandbox, err := AddVirtualDisk(ctx, hostingSystem, hostPath, false, sandboxAccess, &SCSIMountConfig{GuestPath: containerRootPath})
+	if err != nil {
+		removeVPMemOnFailure(hostingSystem, vpmemAdded)
+		removeSCSIROLayersOnFailure(ctx, hostingSystem, scsiROLayersAdded)
+		return nil, nil, err
+	}
+
+	combinedLayers := CombinedLayersV2{
+		ContainerRootPath: containerRootPath,
+		Layers:            layers,
+	}
+	// This Modify call is the guest request: for a HostedSystem the GCS inside
+	// the UVM receives it and assembles the overlayfs, rather than HCS acting
+	// on the host as it does for the WCOW filter above.
+	combinedLayersModification := &ModifySettingsRequestV2{
+		ResourceType:   ResourceTypeCombinedLayers,
+		RequestType:    RequestTypeAdd,
+		HostedSettings: combinedLayers,
 	}
+	if err := modifyWithContext(ctx, hostingSystem, combinedLayersModification); err != nil {
+		removeVPMemOnFailure(hostingSystem, vpmemAdded)
+		removeSCSIROLayersOnFailure(ctx, hostingSystem, scsiROLayersAdded)
+		if err := RemoveVirtualDisk(ctx, hostingSystem, sandbox); err != nil {
+			logger.Warnf("Possibly leaked SCSI disk on error removal path: %s", err)
+		}
+		return nil, nil, err
+	}
+
+	c.combinedLayers.Lock()
+	if c.combinedLayers.paths == nil {
+		c.combinedLayers.paths = make(map[string]bool)
+	}
+	c.combinedLayers.paths[containerRootPath] = true
+	c.combinedLayers.Unlock()
 
-	logrus.Debugln("HCSShim::Mount Succeeded")
-	return combinedLayers, nil
+	logger.Debugln("HCSShim::Mount (LCOW) Succeeded")
+	closer := &lcowXenonCloser{
+		hostingSystem:     hostingSystem,
+		containerRootPath: containerRootPath,
+		sandbox:           sandbox,
+		vpmemAdded:        vpmemAdded,
+		scsiROLayersAdded: scsiROLayersAdded,
+	}
+	return &MountedLayers{RootFS: containerRootPath, Layers: &combinedLayers}, closer, nil
+}
+
+// vpmemFitsLayer reports whether layerPath's backing VHD is small enough to
+// attach over VPMem under MaxVPMemLayerSizeBytes. A layer whose size can't be
+// determined is assumed to fit, so a missing/unreadable layer.vhd doesn't
+// block the VPMem path - Mount will surface the real error when it tries to
+// attach it.
+func vpmemFitsLayer(layerPath string) bool {
+	if MaxVPMemLayerSizeBytes <= 0 {
+		return true
+	}
+	fi, err := os.Stat(filepath.Join(layerPath, "layer.vhd"))
+	if err != nil {
+		return true
+	}
+	return fi.Size() <= MaxVPMemLayerSizeBytes
+}
+
+// allocateSCSIROLayer attaches a read-only layer over SCSI for an LCOW UVM,
+// used when VPMem isn't an option for that layer.
+func allocateSCSIROLayer(ctx context.Context, hostingSystem Container, layerPath string) (*scsiMount, error) {
+	vhdPath := filepath.Join(layerPath, "layer.vhd")
+	return AddVirtualDisk(ctx, hostingSystem, vhdPath, true, VMAccessTypeNoop, nil)
+}
+
+// removeSCSIROLayersOnFailure is a helper to roll back any read-only layers
+// Mount attached over SCSI on a failure path.
+func removeSCSIROLayersOnFailure(ctx context.Context, hostingSystem Container, toRemove []*scsiMount) {
+	for _, mount := range toRemove {
+		if err := RemoveVirtualDisk(ctx, hostingSystem, mount); err != nil {
+			logrus.WithContext(ctx).Warnf("Possibly leaked SCSI disk on error removal path: %s", err)
+		}
+	}
+}
+
+// lcowXenonCloser tears down an LCOW v2 hosted mount: the guest overlay, the
+// SCSI-attached scratch, any read-only layers that fell back to SCSI, and
+// the VPMem devices backing the rest of the read-only layers.
+type lcowXenonCloser struct {
+	released          bool
+	hostingSystem     Container
+	containerRootPath string
+	sandbox           *scsiMount
+	vpmemAdded        []string
+	scsiROLayersAdded []*scsiMount
+}
+
+func (l *lcowXenonCloser) Release(ctx context.Context) error {
+	if l.released {
+		return nil
+	}
+	// Issue the guest overlay-remove request before detaching the backing
+	// devices, so the GCS isn't left holding an overlayfs mount on a device
+	// that's about to disappear out from under it.
+	combinedLayersModification := &ModifySettingsRequestV2{
+		ResourceType:   ResourceTypeCombinedLayers,
+		RequestType:    RequestTypeRemove,
+		HostedSettings: CombinedLayersV2{ContainerRootPath: l.containerRootPath},
+	}
+	if err := modifyWithContext(ctx, l.hostingSystem, combinedLayersModification); err != nil {
+		return err
+	}
+	c := l.hostingSystem.(*container)
+	c.combinedLayers.Lock()
+	delete(c.combinedLayers.paths, l.containerRootPath)
+	c.combinedLayers.Unlock()
+	if err := RemoveVirtualDisk(ctx, l.hostingSystem, l.sandbox); err != nil {
+		return err
+	}
+	for _, mount := range l.scsiROLayersAdded {
+		if err := RemoveVirtualDisk(ctx, l.hostingSystem, mount); err != nil {
+			return err
+		}
+	}
+	for _, path := range l.vpmemAdded {
+		if err := removeVPMem(l.hostingSystem.(*container), path); err != nil {
+			return err
+		}
+	}
+	l.released = true
+	return nil
+}
+
+// allocateVPMem attaches path to the next free VPMem device slot on the
+// utility VM, ref-counting so that sibling containers sharing a read-only
+// layer reuse the same device rather than exhausting the (limited) slot
+// count, and only detaching it once every sharer has released it. Returns
+// errVPMemExhausted, rather than a generic error, when every slot is
+// already in use so callers can fall back to SCSI. The mutex must NOT be
+// held when calling this function.
+func allocateVPMem(c *container, path string) (int, error) {
+	c.vpmemDevices.Lock()
+	defer c.vpmemDevices.Unlock()
+	if c.vpmemDevices.hostPath == nil {
+		c.vpmemDevices.hostPath = make(map[int]string)
+		c.vpmemDevices.refCount = make(map[int]int)
+	}
+	for i, p := range c.vpmemDevices.hostPath {
+		if p == path {
+			c.vpmemDevices.refCount[i]++
+			logrus.Debugf("VPMem: %s refcount: %d", path, c.vpmemDevices.refCount[i])
+			return i, nil
+		}
+	}
+	if len(c.vpmemDevices.hostPath) >= maxVPMemCount {
+		return -1, errVPMemExhausted
+	}
+	deviceNumber := -1
+	for i := 0; i < maxVPMemCount; i++ {
+		if _, used := c.vpmemDevices.hostPath[i]; !used {
+			deviceNumber = i
+			break
+		}
+	}
+	modification := &ModifySettingsRequestV2{
+		ResourceType: ResourceTypeVPMemDevice,
+		RequestType:  RequestTypeAdd,
+		Settings:     VirtualMachinesResourcesStorageVPMemDeviceV2{HostPath: path},
+		ResourceUri:  fmt.Sprintf("VirtualMachine/Devices/VirtualPMem/Mappings/%d", deviceNumber),
+	}
+	if err := c.Modify(modification); err != nil {
+		return -1, err
+	}
+	c.vpmemDevices.hostPath[deviceNumber] = path
+	c.vpmemDevices.refCount[deviceNumber] = 1
+	return deviceNumber, nil
+}
+
+// removeVPMemOnFailure is a helper to roll back any VPMem devices added to a
+// utility VM on a failure path.
+func removeVPMemOnFailure(c Container, toRemove []string) {
+	if len(toRemove) == 0 {
+		return
+	}
+	for _, path := range toRemove {
+		if err := removeVPMem(c.(*container), path); err != nil {
+			logrus.Warnf("Possibly leaked VPMem device on error removal path: %s", err)
+		}
+	}
+}
+
+// removeVPMem decrements path's VPMem device refcount, detaching it once no
+// sharer remains.
+func removeVPMem(c *container, path string) error {
+	c.vpmemDevices.Lock()
+	defer c.vpmemDevices.Unlock()
+	for i, p := range c.vpmemDevices.hostPath {
+		if p == path {
+			c.vpmemDevices.refCount[i]--
+			if c.vpmemDevices.refCount[i] > 0 {
+				return nil
+			}
+			modification := &ModifySettingsRequestV2{
+				ResourceType: ResourceTypeVPMemDevice,
+				RequestType:  RequestTypeRemove,
+				ResourceUri:  fmt.Sprintf("VirtualMachine/Devices/VirtualPMem/Mappings/%d", i),
+			}
+			if err := c.Modify(modification); err != nil {
+				return err
+			}
+			delete(c.vpmemDevices.hostPath, i)
+			delete(c.vpmemDevices.refCount, i)
+			return nil
+		}
+	}
+	return fmt.Errorf("path %s is not attached to a VPMem device", path)
 }
 
 // UnmountOperation is used when calling Unmount() to determine what type of unmount is
@@ -635,8 +1901,19 @@ const (
 	UnmountOperationAll  = UnmountOperationSCSI | UnmountOperationVSMB
 )
 
-// Unmount is a helper for clients to hide all the complexity of layer unmounting
-func Unmount(layerFolders []string, hostingSystem Container, sv *SchemaVersion, op UnmountOperation) error {
+// Unmount is a helper for clients to hide all the complexity of layer
+// unmounting. When closer is non-nil (the ResourceCloser returned by the
+// Mount call being undone), Unmount just dispatches to its Release and
+// returns - the caller doesn't need to still be carrying layerFolders,
+// hostingSystem or sv around, and none of the sv.IsV10()/hostingSystem==nil/
+// UnmountOperation fan-out below applies. closer may be nil for mounts
+// predating ResourceCloser (e.g. reconstructed from persisted state), in
+// which case Unmount falls back to re-deriving everything from layerFolders
+// as it always has.
+func Unmount(ctx context.Context, layerFolders []string, hostingSystem Container, sv *SchemaVersion, op UnmountOperation, closer ResourceCloser) error {
+	if closer != nil {
+		return closer.Release(ctx)
+	}
 	if err := sv.isSupported(); err != nil {
 		return err
 	}
@@ -667,34 +1944,39 @@ func Unmount(layerFolders []string, hostingSystem Container, sv *SchemaVersion,
 
 	var retError error
 	c := hostingSystem.(*container)
+	logger := logrus.WithContext(ctx).WithField("layerFolders", layerFolders)
 
 	// Unload the storage filter followed by the SCSI sandbox
 	if (op | UnmountOperationSCSI) == UnmountOperationSCSI {
 		_, sandboxPath := filepath.Split(layerFolders[len(layerFolders)-1])
 		containerPathGUID, err := NameToGuid(sandboxPath)
 		if err != nil {
-			logrus.Warnf("may leak a sandbox in %s as nametoguid failed: %s", err)
+			logger.Warnf("may leak a sandbox in %s as nametoguid failed: %s", err)
 		} else {
+			containerRootPath := fmt.Sprintf(`C:\%s`, containerPathGUID.ToString())
 			combinedLayersModification := &ModifySettingsRequestV2{
 				ResourceType:   ResourceTypeCombinedLayers,
 				RequestType:    RequestTypeRemove,
-				HostedSettings: CombinedLayersV2{ContainerRootPath: fmt.Sprintf(`C:\%s`, containerPathGUID.ToString())},
+				HostedSettings: CombinedLayersV2{ContainerRootPath: containerRootPath},
 			}
-			if err := hostingSystem.Modify(combinedLayersModification); err != nil {
-				logrus.Errorf(err.Error())
+			if err := modifyWithContext(ctx, hostingSystem, combinedLayersModification); err != nil {
+				logger.WithField("containerRootPath", containerRootPath).Errorf(err.Error())
 			}
+			c.combinedLayers.Lock()
+			delete(c.combinedLayers.paths, containerRootPath)
+			c.combinedLayers.Unlock()
 		}
 
 		// Hot remove the sandbox from the SCSI controller
 		c.scsiLocations.Lock()
 		hostSandboxFile := filepath.Join(layerFolders[len(layerFolders)-1], "sandbox.vhdx")
-		controller, lun, err := findSCSIAttachment(c, hostSandboxFile)
+		controller, lun, err := findSCSIAttachment(ctx, c, hostSandboxFile)
 		if err != nil {
-			logrus.Warnf("sandbox %s is not attached to SCSI - cannot remove!", hostSandboxFile)
+			logger.Warnf("sandbox %s is not attached to SCSI - cannot remove!", hostSandboxFile)
 		} else {
-			if err := removeSCSI(c, controller, lun, fmt.Sprintf(`C:\%s`, containerPathGUID.ToString())); err != nil {
+			if err := removeSCSI(ctx, c, controller, lun, fmt.Sprintf(`C:\%s`, containerPathGUID.ToString())); err != nil {
 				e := fmt.Errorf("failed to remove SCSI %s: %s", hostSandboxFile, err)
-				logrus.Debugln(e)
+				logger.WithFields(logrus.Fields{"controller": controller, "lun": lun}).Debugln(e)
 				if retError == nil {
 					retError = e
 				} else {
@@ -714,33 +1996,34 @@ func Unmount(layerFolders []string, hostingSystem Container, sv *SchemaVersion,
 			c.vsmbShares.guids = make(map[string]int)
 		}
 		for _, layerPath := range layerFolders[:len(layerFolders)-1] {
-			logrus.Debugf("Processing layerPath %s as read-only VSMB share", layerPath)
+			logger.Debugf("Processing layerPath %s as read-only VSMB share", layerPath)
 			_, filename := filepath.Split(layerPath)
 			guid, err := NameToGuid(filename)
 			if err != nil {
-				logrus.Warnf("may have leaked a VSMB share - failed to NameToGuid on %s: %s", filename, err)
+				logger.Warnf("may have leaked a VSMB share - failed to NameToGuid on %s: %s", filename, err)
 				continue
 			}
+			vsmbLogger := logger.WithField("vsmbGUID", guid.ToString())
 			if _, ok := c.vsmbShares.guids[guid.ToString()]; !ok {
-				logrus.Warnf("layer %s is not mounted as a VSMB share - cannot unmount!", layerPath)
+				vsmbLogger.Warnf("layer %s is not mounted as a VSMB share - cannot unmount!", layerPath)
 				continue
 			}
 			c.vsmbShares.guids[guid.ToString()]--
 			if c.vsmbShares.guids[guid.ToString()] > 0 {
-				logrus.Debugf("VSMB read-only layer %s is still in use by another container, not removing from utility VM", layerPath)
+				vsmbLogger.Debugf("VSMB read-only layer %s is still in use by another container, not removing from utility VM", layerPath)
 				continue
 			}
 			delete(c.vsmbShares.guids, guid.ToString())
-			logrus.Debugf("Processing layerPath %s: Perfoming modify to remove VSMB share", layerPath)
+			vsmbLogger.WithField("operation", "Unmount").Debugf("Processing layerPath %s: Perfoming modify to remove VSMB share", layerPath)
 			modification := &ModifySettingsRequestV2{
 				ResourceType: ResourceTypeVSmbShare,
 				RequestType:  RequestTypeRemove,
 				Settings:     VirtualMachinesResourcesStorageVSmbShareV2{Name: guid.ToString()},
 				ResourceUri:  fmt.Sprintf("virtualmachine/devices/virtualsmbshares/%s", guid.ToString()),
 			}
-			if err := hostingSystem.Modify(modification); err != nil {
+			if err := modifyWithContext(ctx, hostingSystem, modification); err != nil {
 				e := fmt.Errorf("failed to remove vsmb share %s: %s: %s", layerPath, modification, err)
-				logrus.Debugln(e)
+				vsmbLogger.Debugln(e)
 				if retError == nil {
 					retError = e
 				} else {
@@ -755,3 +2038,9 @@ func Unmount(layerFolders []string, hostingSystem Container, sv *SchemaVersion,
 
 	return retError
 }
+
+// UnmountLegacy calls Unmount with context.Background(), for callers built
+// before ctx became Unmount's first argument.
+func UnmountLegacy(layerFolders []string, hostingSystem Container, sv *SchemaVersion, op UnmountOperation, closer ResourceCloser) error {
+	return Unmount(context.Background(), layerFolders, hostingSystem, sv, op, closer)
+}
@@ -0,0 +1,253 @@
+package hcsshim
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVsmbShareID(t *testing.T) {
+	id1, err := vsmbShareID("{guid}", VSMBShareOptions{})
+	if err != nil {
+		t.Fatalf("vsmbShareID: %s", err)
+	}
+	id2, err := vsmbShareID("{guid}", VSMBShareOptions{})
+	if err != nil {
+		t.Fatalf("vsmbShareID: %s", err)
+	}
+	if id1 != id2 {
+		t.Fatalf("vsmbShareID is not stable for identical inputs: %q != %q", id1, id2)
+	}
+
+	id3, err := vsmbShareID("{guid}", VSMBShareOptions{DirectMap: true})
+	if err != nil {
+		t.Fatalf("vsmbShareID: %s", err)
+	}
+	if id3 == id1 {
+		t.Fatalf("vsmbShareID returned the same id for different options: %q", id1)
+	}
+
+	id4, err := vsmbShareID("{other-guid}", VSMBShareOptions{})
+	if err != nil {
+		t.Fatalf("vsmbShareID: %s", err)
+	}
+	if id4 == id1 {
+		t.Fatalf("vsmbShareID returned the same id for different guids: %q", id1)
+	}
+}
+
+func TestOsShareVSMBFlags(t *testing.T) {
+	if got := osShareVSMBFlags(VSMBShareOptions{}); got != defaultVSMBFlags {
+		t.Fatalf("zero-value options: got flags %d, want defaultVSMBFlags %d", got, defaultVSMBFlags)
+	}
+
+	got := osShareVSMBFlags(VSMBShareOptions{DirectMap: true})
+	if got&VsmbFlagCacheIO != 0 {
+		t.Fatalf("DirectMap: expected VsmbFlagCacheIO to be cleared, got flags %d", got)
+	}
+
+	got = osShareVSMBFlags(VSMBShareOptions{Flags: VsmbFlagReadOnly, TakeBackupPrivilege: true})
+	if got&VsmbFlagTakeBackupPrivilege == 0 {
+		t.Fatalf("TakeBackupPrivilege with explicit Flags: expected VsmbFlagTakeBackupPrivilege to be set, got flags %d", got)
+	}
+	if got&VsmbFlagReadOnly == 0 {
+		t.Fatalf("explicit Flags override was not preserved: got flags %d", got)
+	}
+}
+
+func TestResolveCredentialSpec(t *testing.T) {
+	t.Run("literal JSON passthrough", func(t *testing.T) {
+		createOptions := &CreateOptions{}
+		resolved, err := resolveCredentialSpec(createOptions, `{"CmsPlugins":["ActiveDirectory"]}`)
+		if err != nil {
+			t.Fatalf("resolveCredentialSpec: %s", err)
+		}
+		if resolved != `{"CmsPlugins":["ActiveDirectory"]}` {
+			t.Fatalf("got %q, want input unchanged", resolved)
+		}
+	})
+
+	t.Run("non-JSON passthrough is rejected", func(t *testing.T) {
+		createOptions := &CreateOptions{}
+		if _, err := resolveCredentialSpec(createOptions, "not json"); err == nil {
+			t.Fatal("expected an error for a non-JSON credential spec, got nil")
+		}
+	})
+
+	t.Run("empty result is rejected", func(t *testing.T) {
+		createOptions := &CreateOptions{}
+		if _, err := resolveCredentialSpec(createOptions, "   "); err == nil {
+			t.Fatal("expected an error for an empty credential spec, got nil")
+		}
+	})
+
+	t.Run("file URI", func(t *testing.T) {
+		root, err := ioutil.TempDir("", "hcsshim-credspec")
+		if err != nil {
+			t.Fatalf("TempDir: %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		specDir := filepath.Join(root, "CredentialSpecs")
+		if err := os.MkdirAll(specDir, 0700); err != nil {
+			t.Fatalf("MkdirAll: %s", err)
+		}
+		const want = `{"CmsPlugins":["ActiveDirectory"]}`
+		if err := ioutil.WriteFile(filepath.Join(specDir, "gmsa.json"), []byte(want), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+
+		createOptions := &CreateOptions{Root: root}
+		resolved, err := resolveCredentialSpec(createOptions, "file://gmsa.json")
+		if err != nil {
+			t.Fatalf("resolveCredentialSpec: %s", err)
+		}
+		if resolved != want {
+			t.Fatalf("got %q, want %q", resolved, want)
+		}
+	})
+
+	t.Run("file URI path traversal is rejected", func(t *testing.T) {
+		root, err := ioutil.TempDir("", "hcsshim-credspec")
+		if err != nil {
+			t.Fatalf("TempDir: %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		secret := filepath.Join(root, "outside-credspecs-dir.json")
+		if err := ioutil.WriteFile(secret, []byte(`{"leaked":true}`), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+
+		createOptions := &CreateOptions{Root: root}
+		if _, err := resolveCredentialSpec(createOptions, "file://../outside-credspecs-dir.json"); err == nil {
+			t.Fatal("expected a path-traversal credential spec filename to be rejected, got nil error")
+		}
+	})
+}
+
+func TestBuildNumberFromOSVersion(t *testing.T) {
+	build, err := buildNumberFromOSVersion("10.0.17763")
+	if err != nil {
+		t.Fatalf("buildNumberFromOSVersion: %s", err)
+	}
+	if build != 17763 {
+		t.Fatalf("got %d, want 17763", build)
+	}
+
+	build, err = buildNumberFromOSVersion("17763")
+	if err != nil {
+		t.Fatalf("buildNumberFromOSVersion: %s", err)
+	}
+	if build != 17763 {
+		t.Fatalf("got %d, want 17763", build)
+	}
+
+	if _, err := buildNumberFromOSVersion("not-a-version"); err == nil {
+		t.Fatal("expected an error for a non-numeric OSVersion, got nil")
+	}
+}
+
+func TestValidateImagePlatformZeroValue(t *testing.T) {
+	// A caller that hasn't populated ImagePlatform gets no check at all,
+	// so this must short-circuit before ever touching createOptions.Spec.
+	if err := validateImagePlatform(&CreateOptions{}); err != nil {
+		t.Fatalf("validateImagePlatform with zero-value ImagePlatform: got %s, want nil", err)
+	}
+}
+
+func TestAllocateSCSILocked(t *testing.T) {
+	c := &container{}
+	c.scsiLocations.hostPath = make([][]string, numSCSIControllers)
+	for i := range c.scsiLocations.hostPath {
+		c.scsiLocations.hostPath[i] = make([]string, numSCSILUNsPerController)
+	}
+
+	// allocateSCSILocked fills LUN 0 across every controller before moving
+	// on to LUN 1, so attachments spread evenly instead of piling onto
+	// controller 0.
+	for lun := 0; lun < 2; lun++ {
+		for wantController := 0; wantController < numSCSIControllers; wantController++ {
+			hostPath := "disk"
+			controller, gotLun, err := allocateSCSILocked(c, hostPath)
+			if err != nil {
+				t.Fatalf("allocateSCSILocked: %s", err)
+			}
+			if controller != wantController || gotLun != lun {
+				t.Fatalf("got (controller=%d, lun=%d), want (controller=%d, lun=%d)", controller, gotLun, wantController, lun)
+			}
+		}
+	}
+
+	// Exhausting every slot should surface a clear error rather than an
+	// out-of-range panic.
+	for controller := 0; controller < numSCSIControllers; controller++ {
+		for lun := 0; lun < numSCSILUNsPerController; lun++ {
+			c.scsiLocations.hostPath[controller][lun] = "taken"
+		}
+	}
+	if _, _, err := allocateSCSILocked(c, "one-too-many"); err == nil {
+		t.Fatal("expected an error once every SCSI slot is full, got nil")
+	}
+}
+
+func TestContainerSaveEncodesMountState(t *testing.T) {
+	c := &container{}
+	c.vsmbShares.guids = map[string]int{"{guid}-deadbeef": 2}
+
+	c.scsiLocations.hostPath = make([][]string, numSCSIControllers)
+	for i := range c.scsiLocations.hostPath {
+		c.scsiLocations.hostPath[i] = make([]string, numSCSILUNsPerController)
+	}
+	c.scsiLocations.hostPath[0][0] = "c:\\sandbox.vhdx"
+	c.scsiLocations.attachRefs = map[string]int{"c:\\sandbox.vhdx": 1}
+	c.scsiLocations.accessGranted = map[string]VMAccessType{"c:\\sandbox.vhdx": VMAccessTypeIndividual}
+	c.scsiLocations.mountRefs = map[string]int{scsiMountKey(0, 0, "/run/mount"): 1}
+
+	c.combinedLayers.paths = map[string]bool{"/run/gcs/c1/rootfs": true}
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	var state MountState
+	if err := gob.NewDecoder(&buf).Decode(&state); err != nil {
+		t.Fatalf("decoding saved MountState: %s", err)
+	}
+
+	if state.SerialVersion != currentMountStateVersion {
+		t.Fatalf("got SerialVersion %d, want %d", state.SerialVersion, currentMountStateVersion)
+	}
+	if got := state.VSMB["{guid}-deadbeef"].RefCount; got != 2 {
+		t.Fatalf("got VSMB refcount %d, want 2", got)
+	}
+	if len(state.SCSI) != 1 {
+		t.Fatalf("got %d SCSI entries, want 1", len(state.SCSI))
+	}
+	entry := state.SCSI[0]
+	if entry.HostPath != "c:\\sandbox.vhdx" || entry.AttachRefs != 1 || entry.AccessGranted != VMAccessTypeIndividual {
+		t.Fatalf("unexpected SCSI entry: %+v", entry)
+	}
+	if len(entry.Mounts) != 1 || entry.Mounts[0].GuestPath != "/run/mount" || entry.Mounts[0].RefCount != 1 {
+		t.Fatalf("unexpected SCSI mounts: %+v", entry.Mounts)
+	}
+	if len(state.Combined) != 1 || state.Combined[0].ContainerRootPath != "/run/gcs/c1/rootfs" {
+		t.Fatalf("unexpected Combined entries: %+v", state.Combined)
+	}
+}
+
+func TestContainerLoadRejectsUnknownVersion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&MountState{SerialVersion: currentMountStateVersion + 1}); err != nil {
+		t.Fatalf("encoding MountState: %s", err)
+	}
+
+	c := &container{}
+	if err := c.Load(&buf); err == nil {
+		t.Fatal("expected Load to reject a MountState with an unknown SerialVersion, got nil")
+	}
+}